@@ -0,0 +1,309 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/network"
+	"istio.io/pkg/log"
+)
+
+// srvScheme is the URL scheme used on a Network_IstioNetworkGateway's Address
+// to request SRV-record based gateway discovery instead of plain A/AAAA
+// lookups, e.g. "srv://_istio-mtls._tcp.gw.example.com".
+const srvScheme = "srv://"
+
+// strategyQueryParam is the query parameter appended to a
+// Network_IstioNetworkGateway's Address to override DefaultGatewayQueryStrategy
+// for that gateway, e.g. "gw.example.com?strategy=ipv4".
+//
+// This piggybacks on the Address string rather than a real field on
+// Network_IstioNetworkGateway because that type is generated from the
+// istio.io/api proto, which isn't vendored into this tree to regenerate.
+// It should be replaced with a proper QueryStrategy field once that's
+// possible; until then, anything else that parses or validates Address as a
+// plain hostname needs to account for this suffix.
+const strategyQueryParam = "strategy="
+
+// GatewayQueryStrategy controls which DNS record types are queried when
+// resolving a gateway hostname to addresses.
+type GatewayQueryStrategy string
+
+const (
+	// GatewayQueryStrategyUseIP queries both A and AAAA and uses every address returned.
+	GatewayQueryStrategyUseIP GatewayQueryStrategy = "ip"
+	// GatewayQueryStrategyUseIPv4 only queries A records.
+	GatewayQueryStrategyUseIPv4 GatewayQueryStrategy = "ipv4"
+	// GatewayQueryStrategyUseIPv6 only queries AAAA records.
+	GatewayQueryStrategyUseIPv6 GatewayQueryStrategy = "ipv6"
+	// GatewayQueryStrategyPreferIPv4 queries A first, falling back to AAAA only if A is NODATA.
+	GatewayQueryStrategyPreferIPv4 GatewayQueryStrategy = "preferv4"
+	// GatewayQueryStrategyPreferIPv6 queries AAAA first, falling back to A only if AAAA is NODATA.
+	GatewayQueryStrategyPreferIPv6 GatewayQueryStrategy = "preferv6"
+)
+
+// DefaultGatewayQueryStrategy is the mesh-wide default query strategy used for
+// gateways that don't override it on their Address (see strategyQueryParam).
+var DefaultGatewayQueryStrategy = GatewayQueryStrategyUseIP
+
+var (
+	networkLog = log.RegisterScope("network", "network and gateway resolution")
+
+	// MinGatewayTTL is the minimum TTL that will be used for a gateway hostname's DNS
+	// resolution, regardless of the TTL returned by the upstream server. This avoids
+	// hammering the resolver when an operator misconfigures a very low TTL.
+	MinGatewayTTL = 5 * time.Second
+
+	// MaxGatewayTTL caps the TTL that will be used for a gateway hostname's DNS
+	// resolution, regardless of the TTL returned by the upstream server. This bounds
+	// how stale a cached answer can get when an upstream advertises a very long TTL.
+	MaxGatewayTTL = 5 * time.Minute
+
+	// NegativeGatewayTTL is the TTL used to cache NXDOMAIN/NODATA answers for a gateway
+	// hostname, so a persistently unresolvable hostname doesn't hammer the upstream
+	// resolver on every re-resolution.
+	NegativeGatewayTTL = 5 * time.Second
+
+	// NetworkGatewayTestDNSServers overrides the list of upstream DNS servers used to
+	// resolve network gateway hostnames. It is only meant to be set from tests; in
+	// production the resolver falls back to the host's configured resolvers.
+	NetworkGatewayTestDNSServers []string
+)
+
+// NetworkGateway is the gateway of a network
+type NetworkGateway struct {
+	// Network is the ID of the network where this gateway resides.
+	Network network.ID
+	// Addr is the IP address of the gateway.
+	Addr string
+	// Port is the port exposed by the gateway.
+	Port uint32
+	// Priority is the DNS SRV priority advertised for this gateway, lower values are
+	// more preferred. It is 0 for gateways discovered via plain A/AAAA lookups.
+	Priority uint32
+	// Weight is the DNS SRV weight advertised for this gateway, intended to
+	// eventually load-balance between same-priority gateways. It is 0 for gateways
+	// discovered via plain A/AAAA lookups.
+	Weight uint32
+}
+
+// Known gap: Priority/Weight are populated from DNS SRV records (see
+// gatewayResolver.resolveSRV) but nothing reads them yet. Honoring them in
+// cross-network load balancing requires an endpoint builder that consumes
+// NetworkManager's output by priority/weight, and no such consumer exists
+// anywhere in this tree - it's a separate piece of follow-up work, not
+// something this package can complete on its own. Whoever adds that consumer
+// should read Priority/Weight off NetworkGateway rather than re-deriving them.
+
+// NetworkGatewaySet is a set of NetworkGateway.
+type NetworkGatewaySet map[NetworkGateway]struct{}
+
+// NetworkManager watches the mesh's MeshNetworks configuration, resolves the
+// hostnames configured for each network's gateways, and republishes a full
+// xDS push whenever the resolved set of gateways changes.
+type NetworkManager struct {
+	environment *Environment
+	xdsUpdater  XDSUpdater
+
+	resolver *gatewayResolver
+
+	mu       sync.RWMutex
+	networks *meshconfig.MeshNetworks
+	// gateways holds the last resolved set of gateways for each watched
+	// gatewayHostKey. A network can configure multiple gateway hostnames, each
+	// resolved independently by its own watch/onResolved callback, so this is
+	// keyed per host rather than per network: keying it per network would have
+	// the most-recently-resolved host's addresses clobber every other host's.
+	gateways map[gatewayHostKey][]NetworkGateway
+}
+
+// InitNetworksManager initializes the Environment's NetworkManager and starts
+// watching the mesh's networks configuration for gateway hostnames that need
+// to be resolved.
+func (e *Environment) InitNetworksManager(xdsUpdater XDSUpdater) error {
+	nm := &NetworkManager{
+		environment: e,
+		xdsUpdater:  xdsUpdater,
+		resolver:    newGatewayResolver(),
+		gateways:    map[gatewayHostKey][]NetworkGateway{},
+	}
+	e.NetworkManager = nm
+
+	if e.NetworksWatcher != nil {
+		e.NetworksWatcher.AddNetworksHandler(nm.reload)
+		nm.reload(e.NetworksWatcher.Networks())
+	}
+	return nil
+}
+
+// reload is invoked whenever the mesh's MeshNetworks configuration changes. It
+// (re)starts hostname resolution for every configured gateway and drops
+// gateways for networks that no longer exist.
+func (n *NetworkManager) reload(meshNetworks *meshconfig.MeshNetworks) {
+	n.mu.Lock()
+	n.networks = meshNetworks
+	n.mu.Unlock()
+
+	wantedHosts := map[gatewayHostKey]struct{}{}
+	if meshNetworks != nil {
+		for nw, network := range meshNetworks.Networks {
+			for _, gw := range network.Gateways {
+				host := gw.GetAddress()
+				if host == "" {
+					continue
+				}
+				isSRV := strings.HasPrefix(host, srvScheme)
+				if isSRV {
+					host = strings.TrimPrefix(host, srvScheme)
+				}
+				host, strategy := splitQueryStrategy(host)
+				key := gatewayHostKey{network: nw, host: host, port: gw.GetPort(), srv: isSRV, strategy: strategy}
+				wantedHosts[key] = struct{}{}
+				n.resolver.watch(key, n.onResolved)
+			}
+		}
+	}
+	n.resolver.reconcile(wantedHosts)
+
+	// drop resolved state for hosts that are no longer configured (including
+	// every host of a removed network, since none of its keys can be wanted).
+	n.mu.Lock()
+	for key := range n.gateways {
+		if _, ok := wantedHosts[key]; !ok {
+			delete(n.gateways, key)
+		}
+	}
+	n.mu.Unlock()
+	n.push()
+}
+
+// splitQueryStrategy splits an optional "?strategy=..." suffix off of host,
+// returning the bare hostname and the GatewayQueryStrategy to use for it
+// (DefaultGatewayQueryStrategy if absent or unrecognized). The returned
+// hostname never includes the "?..." suffix, even when it doesn't match
+// strategyQueryParam or names an unrecognized strategy, so a typo degrades to
+// the bare hostname with the default strategy instead of becoming part of the
+// DNS question name.
+func splitQueryStrategy(host string) (string, GatewayQueryStrategy) {
+	base, query, found := strings.Cut(host, "?")
+	if !found {
+		return host, DefaultGatewayQueryStrategy
+	}
+	if !strings.HasPrefix(query, strategyQueryParam) {
+		return base, DefaultGatewayQueryStrategy
+	}
+	switch s := GatewayQueryStrategy(strings.TrimPrefix(query, strategyQueryParam)); s {
+	case GatewayQueryStrategyUseIP, GatewayQueryStrategyUseIPv4, GatewayQueryStrategyUseIPv6,
+		GatewayQueryStrategyPreferIPv4, GatewayQueryStrategyPreferIPv6:
+		return base, s
+	default:
+		return base, DefaultGatewayQueryStrategy
+	}
+}
+
+// onResolved is the callback invoked by the resolver after every resolution
+// attempt for a gateway hostname. If the attempt could not reach an
+// authoritative answer on any upstream (resolved=false), the previously
+// known gateways for this host are left untouched rather than being cleared,
+// so a transient DNS outage doesn't blackhole cross-network traffic. Results
+// are stored per gatewayHostKey rather than per network, since a network can
+// configure multiple gateway hostnames, each resolved independently; storing
+// per network would have whichever host resolves last overwrite every other
+// host's addresses instead of contributing alongside them.
+func (n *NetworkManager) onResolved(key gatewayHostKey, addrs []resolvedGatewayAddr, resolved bool) {
+	if !resolved {
+		return
+	}
+
+	gws := make([]NetworkGateway, 0, len(addrs))
+	for _, addr := range addrs {
+		gws = append(gws, NetworkGateway{
+			Network:  network.ID(key.network),
+			Addr:     addr.addr,
+			Port:     addr.port,
+			Priority: addr.priority,
+			Weight:   addr.weight,
+		})
+	}
+
+	n.mu.Lock()
+	changed := !gatewaysEqual(n.gateways[key], gws)
+	if len(gws) > 0 || n.gateways[key] != nil {
+		n.gateways[key] = gws
+	}
+	n.mu.Unlock()
+
+	if changed {
+		n.push()
+	}
+}
+
+func gatewaysEqual(a, b []NetworkGateway) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *NetworkManager) push() {
+	if n.xdsUpdater == nil {
+		return
+	}
+	n.xdsUpdater.ConfigUpdate(&PushRequest{Full: true, Reason: NewReasonStats(NetworksTrigger)})
+}
+
+// AllGateways returns all the gateways currently known, across all networks.
+func (n *NetworkManager) AllGateways() []NetworkGateway {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var out []NetworkGateway
+	for _, gws := range n.gateways {
+		out = append(out, gws...)
+	}
+	return out
+}
+
+// IsMultiNetworkEnabled returns true if there is at least one network configured.
+func (n *NetworkManager) IsMultiNetworkEnabled() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.networks != nil && len(n.networks.Networks) > 0
+}
+
+type gatewayHostKey struct {
+	network string
+	host    string
+	port    uint32
+	// srv indicates host should be resolved as a DNS SRV record (which advertises its
+	// own target/port/priority/weight per entry) rather than a plain A/AAAA lookup.
+	srv bool
+	// strategy controls which of A/AAAA are queried for a plain (non-SRV) lookup.
+	strategy GatewayQueryStrategy
+}
+
+func (k gatewayHostKey) String() string {
+	return fmt.Sprintf("%s/%s:%d", k.network, k.host, k.port)
+}
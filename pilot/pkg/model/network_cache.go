@@ -0,0 +1,146 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// prefetchWindow is the fraction of an entry's TTL, counting down from
+// expiry, during which a cache hit on a recently-used entry triggers an
+// asynchronous refresh rather than waiting for the entry to expire.
+const prefetchWindow = 0.1
+
+// gatewayDNSCacheKey identifies a single resource record set.
+type gatewayDNSCacheKey struct {
+	fqdn  string
+	qtype uint16
+}
+
+// gatewayDNSCacheEntry is a cached answer for a gatewayDNSCacheKey, either
+// positive (addrs non-empty) or negative (NXDOMAIN/NODATA).
+type gatewayDNSCacheEntry struct {
+	addrs     []string
+	negative  bool
+	ttl       time.Duration
+	expiresAt time.Time
+	lastUsed  time.Time
+}
+
+func (e *gatewayDNSCacheEntry) expired(now time.Time) bool {
+	return now.After(e.expiresAt)
+}
+
+// nearExpiry reports whether e is inside its prefetch window and was used
+// recently enough to be worth refreshing proactively.
+func (e *gatewayDNSCacheEntry) nearExpiry(now time.Time) bool {
+	if e.ttl <= 0 {
+		return false
+	}
+	remaining := e.expiresAt.Sub(now)
+	return remaining > 0 && remaining < time.Duration(float64(e.ttl)*prefetchWindow) && now.Sub(e.lastUsed) < e.ttl
+}
+
+// gatewayDNSCache caches gateway hostname resolutions, keyed by (fqdn,
+// qtype), with independent TTLs for positive and negative answers. A hit on
+// an entry inside its prefetch window refreshes it in the background before
+// it expires. A resolver watch loop sleeps for the answer's full TTL after an
+// upstream query, so its own next lookup of that entry usually lands after
+// expiry and queries the upstream directly; prefetch is triggered only by
+// hits that arrive inside the window, e.g. from another watch of the same name.
+type gatewayDNSCache struct {
+	refresh func(key gatewayDNSCacheKey) (addrs []string, negative bool, ttl time.Duration, err error)
+
+	mu          sync.Mutex
+	entries     map[gatewayDNSCacheKey]*gatewayDNSCacheEntry
+	prefetching map[gatewayDNSCacheKey]bool
+}
+
+func newGatewayDNSCache(refresh func(key gatewayDNSCacheKey) ([]string, bool, time.Duration, error)) *gatewayDNSCache {
+	return &gatewayDNSCache{
+		refresh:     refresh,
+		entries:     map[gatewayDNSCacheKey]*gatewayDNSCacheEntry{},
+		prefetching: map[gatewayDNSCacheKey]bool{},
+	}
+}
+
+// get returns the cached addresses for key along with whether it was a cache
+// hit, triggering an asynchronous prefetch if the hit is inside its prefetch
+// window.
+func (c *gatewayDNSCache) get(key gatewayDNSCacheKey) (addrs []string, hit bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok || e.expired(now) {
+		c.mu.Unlock()
+		networkGatewayDNSCacheMisses.Increment()
+		return nil, false
+	}
+	e.lastUsed = now
+	shouldPrefetch := e.nearExpiry(now) && !c.prefetching[key]
+	if shouldPrefetch {
+		c.prefetching[key] = true
+	}
+	addrs = e.addrs
+	c.mu.Unlock()
+
+	networkGatewayDNSCacheHits.Increment()
+	if shouldPrefetch {
+		go c.prefetch(key)
+	}
+	return addrs, true
+}
+
+func (c *gatewayDNSCache) prefetch(key gatewayDNSCacheKey) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.prefetching, key)
+		c.mu.Unlock()
+	}()
+	addrs, negative, ttl, err := c.refresh(key)
+	if err != nil {
+		return
+	}
+	c.set(key, addrs, negative, ttl)
+}
+
+// set stores a resolution result, bounding positive TTLs to
+// [MinGatewayTTL, MaxGatewayTTL] and using NegativeGatewayTTL for negative
+// (NXDOMAIN/NODATA) answers.
+func (c *gatewayDNSCache) set(key gatewayDNSCacheKey, addrs []string, negative bool, ttl time.Duration) {
+	if negative {
+		ttl = NegativeGatewayTTL
+	} else {
+		if ttl < MinGatewayTTL {
+			ttl = MinGatewayTTL
+		}
+		if MaxGatewayTTL > 0 && ttl > MaxGatewayTTL {
+			ttl = MaxGatewayTTL
+		}
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &gatewayDNSCacheEntry{
+		addrs:     addrs,
+		negative:  negative,
+		ttl:       ttl,
+		expiresAt: now.Add(ttl),
+		lastUsed:  now,
+	}
+}
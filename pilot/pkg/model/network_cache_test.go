@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGatewayDNSCachePositiveAndNegativeTTL(t *testing.T) {
+	defer func(min, max, neg time.Duration) {
+		MinGatewayTTL = min
+		MaxGatewayTTL = max
+		NegativeGatewayTTL = neg
+	}(MinGatewayTTL, MaxGatewayTTL, NegativeGatewayTTL)
+	MinGatewayTTL = time.Millisecond
+	MaxGatewayTTL = time.Hour
+	NegativeGatewayTTL = 20 * time.Millisecond
+
+	c := newGatewayDNSCache(func(gatewayDNSCacheKey) ([]string, bool, time.Duration, error) {
+		return nil, false, 0, nil
+	})
+	key := gatewayDNSCacheKey{fqdn: "gw.example.com.", qtype: 1}
+
+	c.set(key, []string{"10.0.0.1"}, false, time.Hour)
+	if addrs, hit := c.get(key); !hit || len(addrs) != 1 {
+		t.Fatalf("expected a positive cache hit, got hit=%v addrs=%v", hit, addrs)
+	}
+
+	c.set(key, nil, true, 0)
+	if addrs, hit := c.get(key); !hit || len(addrs) != 0 {
+		t.Fatalf("expected a negative cache hit, got hit=%v addrs=%v", hit, addrs)
+	}
+	time.Sleep(NegativeGatewayTTL * 2)
+	if _, hit := c.get(key); hit {
+		t.Fatal("expected the negative cache entry to have expired")
+	}
+}
+
+func TestGatewayDNSCachePrefetch(t *testing.T) {
+	defer func(min, max time.Duration) {
+		MinGatewayTTL = min
+		MaxGatewayTTL = max
+	}(MinGatewayTTL, MaxGatewayTTL)
+	MinGatewayTTL = time.Millisecond
+	MaxGatewayTTL = time.Hour
+
+	var refreshes int32
+	ttl := 20 * time.Millisecond
+	c := newGatewayDNSCache(func(gatewayDNSCacheKey) ([]string, bool, time.Duration, error) {
+		atomic.AddInt32(&refreshes, 1)
+		return []string{"10.0.0.2"}, false, ttl, nil
+	})
+	key := gatewayDNSCacheKey{fqdn: "gw.example.com.", qtype: 1}
+	c.set(key, []string{"10.0.0.1"}, false, ttl)
+
+	// Poll every millisecond so that some hit lands inside the prefetch window
+	// while the entry is still recently used.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, hit := c.get(key); !hit {
+			t.Fatal("entry should not have expired yet")
+		}
+		if atomic.LoadInt32(&refreshes) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&refreshes) == 0 {
+		t.Fatal("expected a background prefetch to have been triggered before expiry")
+	}
+}
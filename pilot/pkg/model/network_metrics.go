@@ -0,0 +1,45 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"istio.io/istio/pkg/monitoring"
+)
+
+var (
+	upstreamLabel = monitoring.MustCreateLabel("upstream")
+
+	networkGatewayDNSUpstreamDisabled = monitoring.NewGauge(
+		"pilot_network_gateway_dns_upstream_disabled",
+		"Whether a network gateway DNS upstream is currently quarantined (1) or healthy (0).",
+		monitoring.WithLabels(upstreamLabel),
+	)
+
+	networkGatewayDNSUpstreamFailures = monitoring.NewSum(
+		"pilot_network_gateway_dns_upstream_failures_total",
+		"Number of resolution failures observed against a network gateway DNS upstream.",
+		monitoring.WithLabels(upstreamLabel),
+	)
+
+	networkGatewayDNSCacheHits = monitoring.NewSum(
+		"pilot_network_gateway_dns_cache_hits_total",
+		"Number of network gateway DNS resolutions served from cache.",
+	)
+
+	networkGatewayDNSCacheMisses = monitoring.NewSum(
+		"pilot_network_gateway_dns_cache_misses_total",
+		"Number of network gateway DNS resolutions that required an upstream query.",
+	)
+)
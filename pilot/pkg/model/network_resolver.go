@@ -0,0 +1,596 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// gatewayResolver resolves network gateway hostnames to addresses, failing
+// over across a configurable list of upstream DNS servers. Each upstream may
+// be reached over plaintext UDP/TCP, DNS-over-TLS (DoT), DNS-over-HTTPS (DoH)
+// or DNS-over-QUIC (DoQ); the transport is picked from the upstream's URL
+// scheme so operators can mix transports (e.g. a DoH upstream in front of
+// clusters where only encrypted egress is allowed).
+type gatewayResolver struct {
+	mu        sync.Mutex
+	watches   map[gatewayHostKey]*gatewayWatch
+	upstreams *upstreamPool
+	cache     *gatewayDNSCache
+}
+
+func newGatewayResolver() *gatewayResolver {
+	r := &gatewayResolver{
+		watches:   map[gatewayHostKey]*gatewayWatch{},
+		upstreams: newUpstreamPool(),
+	}
+	r.cache = newGatewayDNSCache(r.queryUpstream)
+	return r
+}
+
+type gatewayWatch struct {
+	cancel chan struct{}
+}
+
+// resolvedGatewayAddr is a single resolved gateway endpoint, carrying the
+// port/priority/weight it should be published with. Addresses discovered via
+// plain A/AAAA lookups always have priority and weight 0.
+type resolvedGatewayAddr struct {
+	addr     string
+	port     uint32
+	priority uint32
+	weight   uint32
+}
+
+// watch starts (if not already running) a resolution loop for host key,
+// invoking cb after every resolution attempt with whether it was resolved
+// (see resolve).
+func (r *gatewayResolver) watch(key gatewayHostKey, cb func(gatewayHostKey, []resolvedGatewayAddr, bool)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.watches[key]; ok {
+		return
+	}
+	w := &gatewayWatch{cancel: make(chan struct{})}
+	r.watches[key] = w
+	go r.run(key, w, cb)
+}
+
+// reconcile stops watches for hosts that are no longer wanted.
+func (r *gatewayResolver) reconcile(wanted map[gatewayHostKey]struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, w := range r.watches {
+		if _, ok := wanted[key]; !ok {
+			close(w.cancel)
+			delete(r.watches, key)
+		}
+	}
+}
+
+func (r *gatewayResolver) run(key gatewayHostKey, w *gatewayWatch, cb func(gatewayHostKey, []resolvedGatewayAddr, bool)) {
+	for {
+		var addrs []resolvedGatewayAddr
+		var ttl time.Duration
+		var resolved bool
+		if key.srv {
+			addrs, ttl, resolved = r.resolveSRV(key.host, key.strategy)
+		} else {
+			addrs, ttl, resolved = r.resolveAddrs(key.host, key.port, key.strategy)
+		}
+		cb(key, addrs, resolved)
+
+		if ttl < MinGatewayTTL {
+			ttl = MinGatewayTTL
+		}
+		select {
+		case <-w.cancel:
+			return
+		case <-time.After(ttl):
+		}
+	}
+}
+
+// resolveAddrs looks up host's address records according to strategy, serving
+// cached answers when available and trying each configured upstream in order
+// otherwise. It returns the addresses found (all published with port), the
+// minimum TTL observed, and whether an authoritative answer (positive or
+// negative) was obtained. resolved=false means resolution suffered a
+// transport/server failure, in which case the caller should keep whatever
+// gateways it already has rather than treating "no answer" as "no gateways".
+func (r *gatewayResolver) resolveAddrs(host string, port uint32, strategy GatewayQueryStrategy) ([]resolvedGatewayAddr, time.Duration, bool) {
+	fqdn := dns.Fqdn(host)
+	switch strategy {
+	case GatewayQueryStrategyUseIPv4:
+		return r.resolveQtypes(fqdn, port, dns.TypeA)
+	case GatewayQueryStrategyUseIPv6:
+		return r.resolveQtypes(fqdn, port, dns.TypeAAAA)
+	case GatewayQueryStrategyPreferIPv4:
+		return r.resolvePreferred(fqdn, port, dns.TypeA, dns.TypeAAAA)
+	case GatewayQueryStrategyPreferIPv6:
+		return r.resolvePreferred(fqdn, port, dns.TypeAAAA, dns.TypeA)
+	default: // GatewayQueryStrategyUseIP
+		return r.resolveQtypes(fqdn, port, dns.TypeA, dns.TypeAAAA)
+	}
+}
+
+// resolveQtypes queries every given qtype independently for fqdn and returns
+// the union of the addresses found.
+func (r *gatewayResolver) resolveQtypes(fqdn string, port uint32, qtypes ...uint16) ([]resolvedGatewayAddr, time.Duration, bool) {
+	var out []resolvedGatewayAddr
+	var minTTL time.Duration
+	resolved := false
+	for _, qtype := range qtypes {
+		addrs, ttl, err := r.lookup(gatewayDNSCacheKey{fqdn: fqdn, qtype: qtype})
+		if err != nil {
+			networkLog.Debugf("failed resolving %s (%d): %v", fqdn, qtype, err)
+			continue
+		}
+		resolved = true
+		for _, a := range addrs {
+			out = append(out, resolvedGatewayAddr{addr: a, port: port})
+		}
+		if ttl > 0 && (minTTL == 0 || ttl < minTTL) {
+			minTTL = ttl
+		}
+	}
+	if minTTL == 0 {
+		minTTL = MinGatewayTTL
+	}
+	return out, minTTL, resolved
+}
+
+// resolvePreferred queries primary and only falls back to secondary when
+// primary came back as an authoritative NODATA (no addresses, no error); a
+// hard failure on primary is reported as such rather than masked by a
+// fallback to the other family.
+func (r *gatewayResolver) resolvePreferred(fqdn string, port uint32, primary, secondary uint16) ([]resolvedGatewayAddr, time.Duration, bool) {
+	addrs, ttl, err := r.lookup(gatewayDNSCacheKey{fqdn: fqdn, qtype: primary})
+	if err != nil {
+		networkLog.Debugf("failed resolving %s (%d): %v", fqdn, primary, err)
+		return nil, MinGatewayTTL, false
+	}
+	if len(addrs) > 0 {
+		if ttl == 0 {
+			ttl = MinGatewayTTL
+		}
+		out := make([]resolvedGatewayAddr, 0, len(addrs))
+		for _, a := range addrs {
+			out = append(out, resolvedGatewayAddr{addr: a, port: port})
+		}
+		return out, ttl, true
+	}
+	// primary was an authoritative NODATA: fall back to the other family.
+	return r.resolveQtypes(fqdn, port, secondary)
+}
+
+// lookup serves key from the cache when possible, otherwise queries the
+// upstream pool and populates the cache with the result (positive or
+// negative) before returning.
+func (r *gatewayResolver) lookup(key gatewayDNSCacheKey) ([]string, time.Duration, error) {
+	if addrs, hit := r.cache.get(key); hit {
+		return addrs, 0, nil
+	}
+	addrs, negative, ttl, err := r.queryUpstream(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.cache.set(key, addrs, negative, ttl)
+	return addrs, ttl, nil
+}
+
+// queryUpstream performs a single live DNS exchange for key against the
+// configured upstreams, with failover. key.qtype == dns.TypeSRV is special-
+// cased to the SRV-record exchange path (with each target packed into a
+// cacheable string via encodeSRVTarget) so SRV lookups share the exact same
+// gatewayDNSCache, and therefore the same positive/negative caching and
+// prefetch, as plain A/AAAA lookups.
+func (r *gatewayResolver) queryUpstream(key gatewayDNSCacheKey) (addrs []string, negative bool, ttl time.Duration, err error) {
+	if key.qtype == dns.TypeSRV {
+		targets, ttlSecs, neg, srvErr := r.upstreams.exchangeSRVWithFailover(key.fqdn)
+		if srvErr != nil {
+			return nil, false, 0, srvErr
+		}
+		encoded := make([]string, 0, len(targets))
+		for _, t := range targets {
+			encoded = append(encoded, encodeSRVTarget(t))
+		}
+		return encoded, neg, time.Duration(ttlSecs) * time.Second, nil
+	}
+	a, ttlSecs, neg, err := r.upstreams.exchangeWithFailover(key.fqdn, key.qtype)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return a, neg, time.Duration(ttlSecs) * time.Second, nil
+}
+
+// Known gap: DNSUpstreamFailsTillDeactivate/DNSUpstreamDeactivateBaseCooldown/
+// DNSUpstreamDeactivateMaxCooldown below are not yet operator-configurable
+// via mesh config (e.g. a "runtimeFailsTillDeact" knob): they are plain
+// package vars, mutated only by tests. Wiring them to
+// mesh config would mean adding fields to meshconfig.MeshConfig and reading
+// them from NetworkManager.environment.Mesh() on every reload, but the
+// meshconfig.MeshConfig proto lives in istio.io/api, which is not vendored
+// into this tree to extend or regenerate. Tracked as follow-up work, not
+// something this package can complete on its own.
+var (
+	// DNSUpstreamFailsTillDeactivate is the number of consecutive resolution
+	// failures against an upstream before it is quarantined.
+	DNSUpstreamFailsTillDeactivate = 5
+
+	// DNSUpstreamDeactivateBaseCooldown is the initial cooldown a quarantined
+	// upstream is skipped for; it doubles on every failed re-probe up to
+	// DNSUpstreamDeactivateMaxCooldown.
+	DNSUpstreamDeactivateBaseCooldown = 30 * time.Second
+
+	// DNSUpstreamDeactivateMaxCooldown caps the exponential backoff applied to
+	// a repeatedly-failing upstream.
+	DNSUpstreamDeactivateMaxCooldown = 5 * time.Minute
+
+	// DNSUpstreamQueryTimeout bounds how long a single exchange with one
+	// upstream is allowed to take before it counts as a failure. It is a
+	// package var rather than a constant so tests can shrink it when
+	// exercising an unresponsive upstream without a multi-second runtime.
+	DNSUpstreamQueryTimeout = 5 * time.Second
+)
+
+// upstreamPool holds one dnsUpstream per configured server and fails over
+// across them in order, mirroring the semantics istio's gateway resolution has
+// always had: try the next server on any failure. Upstreams that fail
+// DNSUpstreamFailsTillDeactivate times in a row are quarantined for a
+// cooldown period so a slow/broken server doesn't add its full timeout to
+// every resolution.
+type upstreamPool struct {
+	mu        sync.Mutex
+	addrs     []string
+	upstreams map[string]dnsUpstream
+	state     map[string]*upstreamState
+}
+
+// upstreamState tracks consecutive failures and quarantine status for a
+// single upstream server.
+type upstreamState struct {
+	mu                  sync.Mutex
+	consecutiveFailures int
+	cooldown            time.Duration
+	disabledUntil       time.Time
+}
+
+func (s *upstreamState) isDisabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.disabledUntil.IsZero() && timeNow().Before(s.disabledUntil)
+}
+
+// recoversAt returns when s's quarantine (if any) expires; the zero Time if
+// s isn't quarantined.
+func (s *upstreamState) recoversAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disabledUntil
+}
+
+func (s *upstreamState) recordSuccess(server string) {
+	s.mu.Lock()
+	wasDisabled := !s.disabledUntil.IsZero()
+	s.consecutiveFailures = 0
+	s.cooldown = 0
+	s.disabledUntil = time.Time{}
+	s.mu.Unlock()
+	if wasDisabled {
+		networkGatewayDNSUpstreamDisabled.With(upstreamLabel.Value(server)).Record(0)
+	}
+}
+
+func (s *upstreamState) recordFailure(server string) {
+	s.mu.Lock()
+	s.consecutiveFailures++
+	networkGatewayDNSUpstreamFailures.With(upstreamLabel.Value(server)).Increment()
+	quarantine := s.consecutiveFailures >= DNSUpstreamFailsTillDeactivate
+	if quarantine {
+		if s.cooldown == 0 {
+			s.cooldown = DNSUpstreamDeactivateBaseCooldown
+		} else {
+			s.cooldown *= 2
+			if s.cooldown > DNSUpstreamDeactivateMaxCooldown {
+				s.cooldown = DNSUpstreamDeactivateMaxCooldown
+			}
+		}
+		s.disabledUntil = timeNow().Add(s.cooldown)
+	}
+	s.mu.Unlock()
+	if quarantine {
+		networkGatewayDNSUpstreamDisabled.With(upstreamLabel.Value(server)).Record(1)
+	}
+}
+
+// timeNow is the clock used for quarantine bookkeeping. It is a plain
+// wrapper around time.Now rather than a package var, so tests cannot
+// substitute a fake clock for it.
+func timeNow() time.Time { return time.Now() }
+
+func newUpstreamPool() *upstreamPool {
+	return &upstreamPool{upstreams: map[string]dnsUpstream{}, state: map[string]*upstreamState{}}
+}
+
+func (p *upstreamPool) getState(server string) *upstreamState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.state[server]
+	if !ok {
+		s = &upstreamState{}
+		p.state[server] = s
+	}
+	return s
+}
+
+// servers returns the configured list of upstream server URLs, defaulting to
+// NetworkGatewayTestDNSServers when set (tests only).
+func (p *upstreamPool) servers() []string {
+	if len(NetworkGatewayTestDNSServers) > 0 {
+		return NetworkGatewayTestDNSServers
+	}
+	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || cfg == nil {
+		return nil
+	}
+	var out []string
+	for _, s := range cfg.Servers {
+		out = append(out, net.JoinHostPort(s, cfg.Port))
+	}
+	return out
+}
+
+// usableServers filters out servers currently under quarantine, falling back
+// to re-probing the one whose quarantine expires soonest if every one of
+// them is quarantined, so the pool can recover once connectivity returns.
+func (p *upstreamPool) usableServers(servers []string) []string {
+	usable := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if !p.getState(server).isDisabled() {
+			usable = append(usable, server)
+		}
+	}
+	if len(usable) == 0 && len(servers) > 0 {
+		usable = []string{p.soonestToRecover(servers)}
+	}
+	return usable
+}
+
+// soonestToRecover returns the server among servers whose quarantine cooldown
+// expires soonest (ties broken by order in servers).
+func (p *upstreamPool) soonestToRecover(servers []string) string {
+	best := servers[0]
+	bestRecovery := p.getState(best).recoversAt()
+	for _, server := range servers[1:] {
+		if recovery := p.getState(server).recoversAt(); recovery.Before(bestRecovery) {
+			best, bestRecovery = server, recovery
+		}
+	}
+	return best
+}
+
+func (p *upstreamPool) get(server string) (dnsUpstream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.upstreams[server]; ok {
+		return u, nil
+	}
+	u, err := newDNSUpstream(server)
+	if err != nil {
+		return nil, err
+	}
+	p.upstreams[server] = u
+	return u, nil
+}
+
+// exchangeWithFailover queries fqdn/qtype against each configured upstream in
+// order, returning the first usable answer. Upstreams currently quarantined
+// by a prior run of consecutive failures are skipped so they don't add their
+// full request timeout to this resolution; if every upstream is quarantined
+// the one whose quarantine expires soonest is tried anyway so the resolver
+// can recover once connectivity returns.
+//
+// An authoritative NXDOMAIN/NODATA response is reported as a negative answer
+// (negative=true, err=nil) rather than a failure: it means the upstream is
+// healthy and the name genuinely doesn't exist, so it must not count toward
+// quarantining that upstream, but the caller should still cache it with a
+// short negative TTL.
+func (p *upstreamPool) exchangeWithFailover(fqdn string, qtype uint16) (addrs []string, ttl uint32, negative bool, err error) {
+	servers := p.servers()
+	if len(servers) == 0 {
+		return nil, 0, false, fmt.Errorf("no upstream dns servers configured")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(fqdn, qtype)
+	msg.RecursionDesired = true
+
+	usable := p.usableServers(servers)
+
+	var lastErr error
+	sawNegative := false
+	for _, server := range usable {
+		u, getErr := p.get(server)
+		if getErr != nil {
+			lastErr = getErr
+			continue
+		}
+		state := p.getState(server)
+		ctx, cancel := context.WithTimeout(context.Background(), DNSUpstreamQueryTimeout)
+		resp, exchangeErr := u.exchange(ctx, msg)
+		cancel()
+		if exchangeErr != nil {
+			lastErr = exchangeErr
+			state.recordFailure(server)
+			continue
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			state.recordSuccess(server)
+			if addrs := answerAddrs(resp); len(addrs) > 0 {
+				return addrs, answerTTL(resp), false, nil
+			}
+			// NODATA: the name exists but has no records of this qtype. This is
+			// authoritative, not a failure, so try the next upstream only to look
+			// for a more complete answer, without penalizing this one.
+			sawNegative = true
+			continue
+		case dns.RcodeNameError:
+			// NXDOMAIN is authoritative too; same treatment as NODATA above.
+			state.recordSuccess(server)
+			sawNegative = true
+			continue
+		default:
+			lastErr = fmt.Errorf("upstream %s returned rcode %s", server, dns.RcodeToString[resp.Rcode])
+			state.recordFailure(server)
+		}
+	}
+	// Only trust an authoritative negative answer when no upstream also hit a
+	// hard failure: a NXDOMAIN/NODATA from one server doesn't mean the name
+	// truly doesn't exist if another configured server couldn't be reached at
+	// all, it just means we haven't gotten a real answer yet.
+	if sawNegative && lastErr == nil {
+		return nil, 0, true, nil
+	}
+	return nil, 0, false, lastErr
+}
+
+func answerAddrs(msg *dns.Msg) []string {
+	var out []string
+	for _, rr := range msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			out = append(out, rr.A.String())
+		case *dns.AAAA:
+			out = append(out, rr.AAAA.String())
+		}
+	}
+	return out
+}
+
+func answerTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	for _, rr := range msg.Answer {
+		if ttl == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// dnsUpstream abstracts the transport used to reach a single upstream DNS
+// server, so the resolver above does not need to care whether it is talking
+// plaintext UDP, DoT, DoH or DoQ.
+type dnsUpstream interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// newDNSUpstream builds a dnsUpstream for server, picking the transport from
+// its URL scheme. Servers with no scheme (e.g. "127.0.0.1:53", as used by
+// tests and legacy configuration) default to plain UDP for backwards
+// compatibility.
+func newDNSUpstream(server string) (dnsUpstream, error) {
+	scheme, addr := splitScheme(server)
+	switch scheme {
+	case "", "udp":
+		return &classicUpstream{client: &dns.Client{Net: "udp", Timeout: 5 * time.Second}, addr: addr}, nil
+	case "tcp":
+		return &classicUpstream{client: &dns.Client{Net: "tcp", Timeout: 5 * time.Second}, addr: addr}, nil
+	case "tls":
+		// DNS-over-TLS, RFC 7858.
+		host, dialAddr, err := bootstrapResolve(addr, "853")
+		if err != nil {
+			return nil, err
+		}
+		return &classicUpstream{
+			client: &dns.Client{Net: "tcp-tls", Timeout: 5 * time.Second, TLSConfig: &tls.Config{ServerName: host}},
+			addr:   dialAddr,
+		}, nil
+	case "https":
+		// DNS-over-HTTPS, RFC 8484.
+		host, dialAddr, err := bootstrapResolve(addr, "443")
+		if err != nil {
+			return nil, err
+		}
+		return newDoHUpstream(host, dialAddr)
+	case "quic":
+		// DNS-over-QUIC, RFC 9250.
+		host, dialAddr, err := bootstrapResolve(addr, "853")
+		if err != nil {
+			return nil, err
+		}
+		return newDoQUpstream(host, dialAddr)
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream scheme %q", scheme)
+	}
+}
+
+// splitScheme splits a server URL of the form "scheme://host:port" into its
+// scheme and host:port. Inputs without a scheme are returned as ("", input).
+func splitScheme(server string) (string, string) {
+	if !strings.Contains(server, "://") {
+		return "", server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", server
+	}
+	return u.Scheme, u.Host
+}
+
+// bootstrapResolve resolves the hostname part of addr (defaulting to
+// defaultPort when addr has no explicit port) using the system resolver, so
+// encrypted-transport upstreams can themselves be configured by hostname
+// (e.g. "tls://dns.example.com:853") without every subsequent query falling
+// back to the plaintext resolver the encrypted transport exists to bypass.
+// It returns the original hostname (for use as the TLS ServerName/SNI, so
+// certificate validation and virtual-hosted providers keep working) and the
+// "ip:port" to actually dial.
+func bootstrapResolve(addr, defaultPort string) (host, dialAddr string, err error) {
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		host, port = addr, defaultPort
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return host, net.JoinHostPort(host, port), nil
+	}
+	ips, lookupErr := net.LookupHost(host)
+	if lookupErr != nil || len(ips) == 0 {
+		return "", "", fmt.Errorf("bootstrap resolution of %s failed: %w", host, lookupErr)
+	}
+	return host, net.JoinHostPort(ips[0], port), nil
+}
+
+// classicUpstream covers plain UDP, TCP and DoT, all of which miekg/dns
+// already implements a *dns.Client for; only the Net/TLSConfig differ.
+type classicUpstream struct {
+	client *dns.Client
+	addr   string
+}
+
+func (u *classicUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.ExchangeContext(ctx, msg, u.addr)
+	return resp, err
+}
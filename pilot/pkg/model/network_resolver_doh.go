@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohUpstream implements DNS-over-HTTPS (RFC 8484) using the "DNS wireformat"
+// POST encoding. The *http.Client (and therefore its connection pool) is
+// shared across every exchange made against this upstream.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+// newDoHUpstream builds a dohUpstream that always dials dialAddr (an
+// "ip:port" produced by bootstrapResolve), while using host as the TLS
+// ServerName and HTTP Host header so SNI and virtual-hosted DoH providers
+// still see the original hostname. This keeps every subsequent query off of
+// the plaintext system resolver, which is the whole point of DoH.
+func newDoHUpstream(host, dialAddr string) (dnsUpstream, error) {
+	_, port, err := net.SplitHostPort(dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &dohUpstream{
+		url: "https://" + net.JoinHostPort(host, port) + "/dns-query",
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, dialAddr)
+				},
+				TLSClientConfig: &tls.Config{ServerName: host},
+			},
+		},
+	}, nil
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream %s returned status %d", u.url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, fmt.Errorf("doh upstream %s returned unparseable response: %w", u.url, err)
+	}
+	return out, nil
+}
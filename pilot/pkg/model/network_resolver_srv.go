@@ -0,0 +1,181 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// srvTarget is a single entry of a resolved SRV record.
+type srvTarget struct {
+	target   string
+	port     uint32
+	priority uint32
+	weight   uint32
+}
+
+// resolveSRV resolves host as a DNS SRV record and then A/AAAA-resolves each
+// target it advertises (honoring strategy, same as a plain gateway lookup),
+// preserving the priority/weight/port the SRV record advertised for that
+// target. A target that itself fails to resolve is skipped (its siblings are
+// still returned) so one bad record doesn't blackhole the whole gateway.
+//
+// The SRV lookup itself goes through the same gatewayDNSCache as plain
+// A/AAAA lookups (keyed by (fqdn, dns.TypeSRV)), so a gateway configured via
+// srv:// gets the same positive/negative caching and prefetch chunk0-3 added
+// for plain lookups instead of re-querying the upstream on every poll cycle.
+func (r *gatewayResolver) resolveSRV(host string, strategy GatewayQueryStrategy) ([]resolvedGatewayAddr, time.Duration, bool) {
+	fqdn := dns.Fqdn(host)
+	encoded, ttl, err := r.lookup(gatewayDNSCacheKey{fqdn: fqdn, qtype: dns.TypeSRV})
+	if err != nil {
+		networkLog.Debugf("failed resolving SRV record %s: %v", host, err)
+		return nil, 0, false
+	}
+
+	targets := make([]srvTarget, 0, len(encoded))
+	for _, e := range encoded {
+		t, decErr := decodeSRVTarget(e)
+		if decErr != nil {
+			networkLog.Debugf("failed decoding cached SRV target for %s: %v", host, decErr)
+			continue
+		}
+		targets = append(targets, t)
+	}
+
+	var out []resolvedGatewayAddr
+	minTTL := ttl
+	for _, t := range targets {
+		addrs, addrTTL, resolved := r.resolveAddrs(t.target, t.port, strategy)
+		if !resolved {
+			networkLog.Debugf("failed resolving SRV target %s", t.target)
+			continue
+		}
+		for _, a := range addrs {
+			out = append(out, resolvedGatewayAddr{addr: a.addr, port: a.port, priority: t.priority, weight: t.weight})
+		}
+		if addrTTL > 0 && (minTTL == 0 || addrTTL < minTTL) {
+			minTTL = addrTTL
+		}
+	}
+	if minTTL == 0 {
+		minTTL = MinGatewayTTL
+	}
+	return out, minTTL, true
+}
+
+// exchangeSRVWithFailover is exchangeWithFailover's SRV-record counterpart:
+// same upstream iteration, quarantine and negative-answer semantics, but
+// parsing dns.SRV answers instead of A/AAAA ones.
+func (p *upstreamPool) exchangeSRVWithFailover(fqdn string) (targets []srvTarget, ttl uint32, negative bool, err error) {
+	servers := p.servers()
+	if len(servers) == 0 {
+		return nil, 0, false, fmt.Errorf("no upstream dns servers configured")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(fqdn, dns.TypeSRV)
+	msg.RecursionDesired = true
+
+	usable := p.usableServers(servers)
+
+	var lastErr error
+	sawNegative := false
+	for _, server := range usable {
+		u, getErr := p.get(server)
+		if getErr != nil {
+			lastErr = getErr
+			continue
+		}
+		state := p.getState(server)
+		ctx, cancel := context.WithTimeout(context.Background(), DNSUpstreamQueryTimeout)
+		resp, exchangeErr := u.exchange(ctx, msg)
+		cancel()
+		if exchangeErr != nil {
+			lastErr = exchangeErr
+			state.recordFailure(server)
+			continue
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			state.recordSuccess(server)
+			if srvs := answerSRVs(resp); len(srvs) > 0 {
+				return srvs, answerTTL(resp), false, nil
+			}
+			sawNegative = true
+			continue
+		case dns.RcodeNameError:
+			state.recordSuccess(server)
+			sawNegative = true
+			continue
+		default:
+			lastErr = fmt.Errorf("upstream %s returned rcode %s", server, dns.RcodeToString[resp.Rcode])
+			state.recordFailure(server)
+		}
+	}
+	if sawNegative && lastErr == nil {
+		return nil, 0, true, nil
+	}
+	return nil, 0, false, lastErr
+}
+
+// encodeSRVTarget and decodeSRVTarget pack/unpack an srvTarget into the
+// single string gatewayDNSCache already knows how to cache, so resolveSRV
+// can reuse it as-is instead of teaching the cache a second value type.
+func encodeSRVTarget(t srvTarget) string {
+	return fmt.Sprintf("%s:%d:%d:%d", t.target, t.port, t.priority, t.weight)
+}
+
+func decodeSRVTarget(s string) (srvTarget, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return srvTarget{}, fmt.Errorf("malformed cached SRV target %q", s)
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return srvTarget{}, fmt.Errorf("malformed cached SRV target %q: %w", s, err)
+	}
+	priority, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return srvTarget{}, fmt.Errorf("malformed cached SRV target %q: %w", s, err)
+	}
+	weight, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil {
+		return srvTarget{}, fmt.Errorf("malformed cached SRV target %q: %w", s, err)
+	}
+	return srvTarget{target: parts[0], port: uint32(port), priority: uint32(priority), weight: uint32(weight)}, nil
+}
+
+func answerSRVs(msg *dns.Msg) []srvTarget {
+	var out []srvTarget
+	for _, rr := range msg.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		out = append(out, srvTarget{
+			target:   srv.Target,
+			port:     uint32(srv.Port),
+			priority: uint32(srv.Priority),
+			weight:   uint32(srv.Weight),
+		})
+	}
+	return out
+}
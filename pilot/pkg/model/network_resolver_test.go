@@ -0,0 +1,360 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func TestSplitScheme(t *testing.T) {
+	cases := []struct {
+		in         string
+		wantScheme string
+		wantAddr   string
+	}{
+		{"127.0.0.1:53", "", "127.0.0.1:53"},
+		{"udp://127.0.0.1:53", "udp", "127.0.0.1:53"},
+		{"tcp://127.0.0.1:53", "tcp", "127.0.0.1:53"},
+		{"tls://dns.example.com:853", "tls", "dns.example.com:853"},
+		{"https://dns.example.com:443", "https", "dns.example.com:443"},
+		{"quic://dns.example.com:853", "quic", "dns.example.com:853"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			scheme, addr := splitScheme(tt.in)
+			if scheme != tt.wantScheme || addr != tt.wantAddr {
+				t.Fatalf("splitScheme(%q) = (%q, %q), want (%q, %q)", tt.in, scheme, addr, tt.wantScheme, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestNewDNSUpstreamUnsupportedScheme(t *testing.T) {
+	if _, err := newDNSUpstream("ftp://127.0.0.1:53"); err == nil {
+		t.Fatal("expected an error for an unsupported upstream scheme")
+	}
+}
+
+func TestUpstreamQuarantine(t *testing.T) {
+	defer func(n int, base, max time.Duration) {
+		DNSUpstreamFailsTillDeactivate = n
+		DNSUpstreamDeactivateBaseCooldown = base
+		DNSUpstreamDeactivateMaxCooldown = max
+	}(DNSUpstreamFailsTillDeactivate, DNSUpstreamDeactivateBaseCooldown, DNSUpstreamDeactivateMaxCooldown)
+	DNSUpstreamFailsTillDeactivate = 2
+	DNSUpstreamDeactivateBaseCooldown = time.Minute
+	DNSUpstreamDeactivateMaxCooldown = time.Minute
+
+	s := &upstreamState{}
+	if s.isDisabled() {
+		t.Fatal("a fresh upstream should not start quarantined")
+	}
+
+	s.recordFailure("bad")
+	if s.isDisabled() {
+		t.Fatal("should not be quarantined before the failure threshold is reached")
+	}
+
+	s.recordFailure("bad")
+	if !s.isDisabled() {
+		t.Fatal("should be quarantined once the failure threshold is reached")
+	}
+
+	s.recordSuccess("bad")
+	if s.isDisabled() {
+		t.Fatal("a successful probe should re-enable the upstream")
+	}
+}
+
+// TestUsableServersFallsBackToSoonestToRecover covers usableServers' "every
+// upstream quarantined" fallback: it must retry the one whose cooldown
+// expires soonest, not simply the first configured server regardless of its
+// remaining cooldown.
+func TestUsableServersFallsBackToSoonestToRecover(t *testing.T) {
+	p := newUpstreamPool()
+	now := timeNow()
+
+	// "later" is configured first but recovers after "soonest".
+	p.getState("later").disabledUntil = now.Add(time.Minute)
+	p.getState("soonest").disabledUntil = now.Add(time.Second)
+
+	usable := p.usableServers([]string{"later", "soonest"})
+	if len(usable) != 1 || usable[0] != "soonest" {
+		t.Fatalf("expected fallback to the soonest-to-recover server, got %v", usable)
+	}
+}
+
+// TestUpstreamPoolQuarantineShortCircuitsDeadUpstream exercises quarantine
+// through the real resolve path (upstreamPool.exchangeWithFailover against
+// actual UDP sockets), not just upstreamState in isolation: a dead upstream
+// that never replies should make every exchange pay for the full query
+// timeout until it accumulates DNSUpstreamFailsTillDeactivate failures, after
+// which exchanges should short-circuit straight to the working upstream.
+func TestUpstreamPoolQuarantineShortCircuitsDeadUpstream(t *testing.T) {
+	defer func(n int, base, max, timeout time.Duration) {
+		DNSUpstreamFailsTillDeactivate = n
+		DNSUpstreamDeactivateBaseCooldown = base
+		DNSUpstreamDeactivateMaxCooldown = max
+		DNSUpstreamQueryTimeout = timeout
+	}(DNSUpstreamFailsTillDeactivate, DNSUpstreamDeactivateBaseCooldown, DNSUpstreamDeactivateMaxCooldown, DNSUpstreamQueryTimeout)
+	DNSUpstreamFailsTillDeactivate = 2
+	DNSUpstreamDeactivateBaseCooldown = time.Minute
+	DNSUpstreamDeactivateMaxCooldown = time.Minute
+	DNSUpstreamQueryTimeout = 200 * time.Millisecond
+
+	// deadConn reads and discards every packet, simulating an unresponsive
+	// upstream that would otherwise add its full query timeout to every
+	// resolve attempt.
+	deadConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open dead upstream: %v", err)
+	}
+	defer deadConn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := deadConn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	fqdn := dns.Fqdn("gw.example.com")
+	workingAddr := startFakeWorkingDNSServer(t, fqdn, net.ParseIP("10.0.0.5"))
+
+	defer func(s []string) { NetworkGatewayTestDNSServers = s }(NetworkGatewayTestDNSServers)
+	NetworkGatewayTestDNSServers = []string{deadConn.LocalAddr().String(), workingAddr}
+	pool := newUpstreamPool()
+
+	for i := 0; i < DNSUpstreamFailsTillDeactivate; i++ {
+		start := time.Now()
+		addrs, _, negative, err := pool.exchangeWithFailover(fqdn, dns.TypeA)
+		elapsed := time.Since(start)
+		if err != nil || negative || len(addrs) == 0 {
+			t.Fatalf("call %d: expected the working upstream to answer, got addrs=%v negative=%v err=%v", i, addrs, negative, err)
+		}
+		if elapsed < DNSUpstreamQueryTimeout {
+			t.Fatalf("call %d: expected to pay for the dead upstream's timeout before quarantine, took %v", i, elapsed)
+		}
+	}
+
+	start := time.Now()
+	addrs, _, negative, err := pool.exchangeWithFailover(fqdn, dns.TypeA)
+	elapsed := time.Since(start)
+	if err != nil || negative || len(addrs) == 0 {
+		t.Fatalf("expected the working upstream to still answer, got addrs=%v negative=%v err=%v", addrs, negative, err)
+	}
+	if elapsed >= DNSUpstreamQueryTimeout {
+		t.Fatalf("expected the dead upstream to be quarantined and skipped, took %v", elapsed)
+	}
+}
+
+// startFakeWorkingDNSServer starts a UDP DNS server on an ephemeral port that
+// always answers fqdn's A query with ip, and registers its shutdown on
+// t.Cleanup.
+func startFakeWorkingDNSServer(t *testing.T, fqdn string, ip net.IP) string {
+	t.Helper()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	srv := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", NotifyStartedFunc: wg.Done}
+	srv.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := (&dns.Msg{}).SetReply(r)
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		})
+		_ = w.WriteMsg(msg)
+	})
+	go func() {
+		_ = srv.ListenAndServe()
+	}()
+	wg.Wait()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return srv.PacketConn.LocalAddr().String()
+}
+
+// TestDoHUpstreamExchange exercises dohUpstream.exchange end-to-end against a
+// real HTTP server speaking the RFC 8484 wireformat, rather than only testing
+// scheme dispatch.
+func TestDoHUpstreamExchange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.0.0.9"),
+		})
+		packed, err := resp.Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	defer server.Close()
+
+	u := &dohUpstream{url: server.URL, client: server.Client()}
+	msg := new(dns.Msg)
+	msg.SetQuestion("gw.example.com.", dns.TypeA)
+
+	resp, err := u.exchange(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	addrs := answerAddrs(resp)
+	if len(addrs) != 1 || addrs[0] != "10.0.0.9" {
+		t.Fatalf("unexpected addresses: %v", addrs)
+	}
+}
+
+// TestDoQUpstreamExchange exercises doqUpstream.exchange end-to-end against a
+// real QUIC listener, verifying the RFC 9250 length-prefixed framing and the
+// message-ID-0-on-the-wire/restore-on-response behavior.
+func TestDoQUpstreamExchange(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{generateSelfSignedCert(t)},
+		NextProtos:   doqALPN,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to start fake doq server: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(stream, lenBuf); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		if req.Id != 0 {
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.0.0.7"),
+		})
+		packed, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		out := make([]byte, 2+len(packed))
+		binary.BigEndian.PutUint16(out, uint16(len(packed)))
+		copy(out[2:], packed)
+		_, _ = stream.Write(out)
+	}()
+
+	u := &doqUpstream{addr: ln.Addr().String(), sni: "dns.example.com", insecureSkipVerify: true}
+	msg := new(dns.Msg)
+	msg.Id = 1234
+	msg.SetQuestion("gw.example.com.", dns.TypeA)
+
+	resp, err := u.exchange(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Id != msg.Id {
+		t.Fatalf("expected response id restored to %d, got %d", msg.Id, resp.Id)
+	}
+	addrs := answerAddrs(resp)
+	if len(addrs) != 1 || addrs[0] != "10.0.0.7" {
+		t.Fatalf("unexpected addresses: %v", addrs)
+	}
+}
+
+// generateSelfSignedCert returns a throwaway self-signed TLS certificate, for
+// use by tests that need a local DoT/DoQ-style TLS listener.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load keypair: %v", err)
+	}
+	return cert
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -37,6 +38,7 @@ import (
 
 func TestGatewayHostnames(t *testing.T) {
 	test.SetForTest(t, &model.MinGatewayTTL, 30*time.Millisecond)
+	test.SetForTest(t, &model.NegativeGatewayTTL, 30*time.Millisecond)
 
 	gwHost := "test.gw.istio.io"
 	workingDNSServer := newFakeDNSServer(":15353", 1, sets.New(gwHost))
@@ -136,6 +138,19 @@ func TestGatewayHostnames(t *testing.T) {
 		xdsUpdater.WaitOrFail(t, "xds full")
 	})
 
+	stableGateways := env.NetworkManager.AllGateways()
+	t.Run("cached answer yields no redundant push", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip()
+		}
+		// The answer's 1s TTL outlasts this window, so the gateway is not
+		// re-resolved during it and no further xDS push may be observed.
+		xdsUpdater.AssertEmpty(t, 100*time.Millisecond)
+		if !reflect.DeepEqual(env.NetworkManager.AllGateways(), stableGateways) {
+			t.Fatalf("unexpected gateway change: %v", env.NetworkManager.AllGateways())
+		}
+	})
+
 	t.Run("forget", func(t *testing.T) {
 		meshNetworks.SetNetworks(nil)
 		xdsUpdater.WaitOrFail(t, "xds full")
@@ -145,6 +160,323 @@ func TestGatewayHostnames(t *testing.T) {
 	})
 }
 
+// TestGatewayMultipleHostsPerNetwork guards against a network's gateways
+// being keyed per network instead of per (network, host): with last-writer-
+// wins keying, whichever of the two hostnames resolved most recently would
+// silently clobber the other's addresses instead of both contributing.
+func TestGatewayMultipleHostsPerNetwork(t *testing.T) {
+	test.SetForTest(t, &model.MinGatewayTTL, time.Hour)
+
+	host1 := "gw1.istio.io"
+	host2 := "gw2.istio.io"
+	dnsServer := newFakeDNSServer(":36353", 60, sets.New(host1, host2))
+	model.NetworkGatewayTestDNSServers = []string{dnsServer.Server.PacketConn.LocalAddr().String()}
+	t.Cleanup(func() {
+		if err := dnsServer.Shutdown(); err != nil {
+			t.Logf("failed shutting down fake dns server: %v", err)
+		}
+	})
+
+	meshNetworks := mesh.NewFixedNetworksWatcher(nil)
+	xdsUpdater := xdsfake.NewFakeXDS()
+	env := &model.Environment{NetworksWatcher: meshNetworks, ServiceDiscovery: memory.NewServiceDiscovery()}
+	if err := env.InitNetworksManager(xdsUpdater); err != nil {
+		t.Fatal(err)
+	}
+	meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{
+			{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: host1}, Port: 15443},
+			{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: host2}, Port: 15443},
+		}},
+	}})
+	xdsUpdater.WaitOrFail(t, "xds full")
+
+	retry.UntilOrFail(t, func() bool {
+		// each host resolves to A+AAAA independently of the other; both hosts'
+		// addresses must be present together, not one clobbering the other.
+		return len(env.NetworkManager.AllGateways()) == 4
+	})
+	gateways := env.NetworkManager.AllGateways()
+	if len(gateways) != 4 {
+		t.Fatalf("expected 4 gateways (2 hosts x A/AAAA), got %d: %v", len(gateways), gateways)
+	}
+}
+
+func TestGatewaySRVDiscovery(t *testing.T) {
+	test.SetForTest(t, &model.MinGatewayTTL, 30*time.Millisecond)
+
+	srvName := "_istio-mtls._tcp.gw.istio.io"
+	targetA := "gw-a.istio.io"
+	targetB := "gw-b.istio.io"
+	targetMissing := "gw-missing.istio.io"
+
+	dnsServer := newFakeDNSServer(":35353", 60, sets.New(targetA, targetB))
+	dnsServer.setSRV(srvName, []dns.SRV{
+		{Priority: 10, Weight: 20, Port: 15443, Target: dns.Fqdn(targetA)},
+		{Priority: 20, Weight: 80, Port: 15444, Target: dns.Fqdn(targetB)},
+		// a target that can never resolve must not prevent its siblings from being used.
+		{Priority: 30, Weight: 100, Port: 15445, Target: dns.Fqdn(targetMissing)},
+	})
+	model.NetworkGatewayTestDNSServers = []string{dnsServer.Server.PacketConn.LocalAddr().String()}
+	t.Cleanup(func() {
+		if err := dnsServer.Shutdown(); err != nil {
+			t.Logf("failed shutting down fake dns server: %v", err)
+		}
+	})
+
+	meshNetworks := mesh.NewFixedNetworksWatcher(nil)
+	xdsUpdater := xdsfake.NewFakeXDS()
+	env := &model.Environment{NetworksWatcher: meshNetworks, ServiceDiscovery: memory.NewServiceDiscovery()}
+	if err := env.InitNetworksManager(xdsUpdater); err != nil {
+		t.Fatal(err)
+	}
+
+	meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw: &meshconfig.Network_IstioNetworkGateway_Address{
+				Address: "srv://" + srvName,
+			},
+		}}},
+	}})
+	xdsUpdater.WaitOrFail(t, "xds full")
+
+	// Each resolvable target advertises both an A and an AAAA record, so each
+	// should contribute two gateways (one per address family).
+	var gateways []model.NetworkGateway
+	retry.UntilOrFail(t, func() bool {
+		gateways = env.NetworkManager.AllGateways()
+		return len(gateways) == 4
+	})
+
+	byPort := map[uint32][]model.NetworkGateway{}
+	for _, gw := range gateways {
+		byPort[gw.Port] = append(byPort[gw.Port], gw)
+	}
+
+	checkTarget := func(port, wantPriority, wantWeight uint32) {
+		t.Helper()
+		gws, ok := byPort[port]
+		if !ok || len(gws) != 2 {
+			t.Fatalf("expected an A and an AAAA gateway for port %d, got %v", port, gws)
+		}
+		var gotV4, gotV6 bool
+		for _, gw := range gws {
+			if gw.Priority != wantPriority || gw.Weight != wantWeight {
+				t.Fatalf("expected priority=%d weight=%d for port %d, got %v", wantPriority, wantWeight, port, gw)
+			}
+			if strings.Contains(gw.Addr, ":") {
+				gotV6 = true
+			} else {
+				gotV4 = true
+			}
+		}
+		if !gotV4 || !gotV6 {
+			t.Fatalf("expected both an A and an AAAA address for port %d, got %v", port, gws)
+		}
+	}
+	checkTarget(15443, 10, 20)
+	checkTarget(15444, 20, 80)
+	if _, ok := byPort[15445]; ok {
+		t.Fatalf("expected the unresolvable SRV target to be skipped, got %v", byPort)
+	}
+}
+
+// TestGatewaySRVCachedAcrossPolls guards against SRV lookups bypassing
+// gatewayDNSCache: while a long-TTL SRV answer is cached, another run loop
+// resolving the same SRV name must be served from the cache instead of
+// re-querying the upstream, the same as a plain A/AAAA gateway lookup.
+func TestGatewaySRVCachedAcrossPolls(t *testing.T) {
+	test.SetForTest(t, &model.MinGatewayTTL, 10*time.Millisecond)
+
+	srvName := "_istio-mtls._tcp.cached.gw.istio.io"
+	target := "cached-target.istio.io"
+
+	const srvTTL = 60 // seconds; far longer than this test's run time.
+	dnsServer := newFakeDNSServer(":37353", srvTTL, sets.New(target))
+	dnsServer.setSRV(srvName, []dns.SRV{{Priority: 1, Weight: 1, Port: 15443, Target: dns.Fqdn(target)}})
+	model.NetworkGatewayTestDNSServers = []string{dnsServer.Server.PacketConn.LocalAddr().String()}
+	t.Cleanup(func() {
+		if err := dnsServer.Shutdown(); err != nil {
+			t.Logf("failed shutting down fake dns server: %v", err)
+		}
+	})
+
+	meshNetworks := mesh.NewFixedNetworksWatcher(nil)
+	xdsUpdater := xdsfake.NewFakeXDS()
+	env := &model.Environment{NetworksWatcher: meshNetworks, ServiceDiscovery: memory.NewServiceDiscovery()}
+	if err := env.InitNetworksManager(xdsUpdater); err != nil {
+		t.Fatal(err)
+	}
+	meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "srv://" + srvName},
+		}}},
+	}})
+	xdsUpdater.WaitOrFail(t, "xds full")
+	retry.UntilOrFail(t, func() bool {
+		return len(env.NetworkManager.AllGateways()) == 2
+	})
+
+	// A run loop sleeps for the answer's full TTL after querying the upstream,
+	// so the cache is exercised by a second network's run loop resolving the
+	// same SRV name while the first answer is still cached.
+	meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "srv://" + srvName},
+		}}},
+		"nw1": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "srv://" + srvName},
+		}}},
+	}})
+	retry.UntilOrFail(t, func() bool {
+		return len(env.NetworkManager.AllGateways()) == 4
+	})
+	if n := dnsServer.srvQueryCount(srvName); n != 1 {
+		t.Fatalf("expected exactly 1 SRV query to be served (rest from cache), got %d", n)
+	}
+}
+
+// TestGatewayFlappingUpstreamPushesOncePerChange covers a flapping upstream
+// (one whose answer keeps changing, rather than a stable one served from
+// cache): every resolved address change must yield exactly one xDS push, with
+// no push for an answer that repeats a gateway set already published.
+func TestGatewayFlappingUpstreamPushesOncePerChange(t *testing.T) {
+	test.SetForTest(t, &model.MinGatewayTTL, 10*time.Millisecond)
+	test.SetForTest(t, &model.NegativeGatewayTTL, 10*time.Millisecond)
+
+	gwHost := "flap.gw.istio.io"
+	// fakeDNSServer bumps a per-host counter into the returned address on
+	// every successful query, so with a short TTL forcing fresh lookups, the
+	// resolved address keeps flapping.
+	dnsServer := newFakeDNSServer(":55355", 1, sets.New(gwHost))
+	model.NetworkGatewayTestDNSServers = []string{dnsServer.Server.PacketConn.LocalAddr().String()}
+	t.Cleanup(func() {
+		if err := dnsServer.Shutdown(); err != nil {
+			t.Logf("failed shutting down fake dns server: %v", err)
+		}
+	})
+
+	meshNetworks := mesh.NewFixedNetworksWatcher(nil)
+	xdsUpdater := xdsfake.NewFakeXDS()
+	env := &model.Environment{NetworksWatcher: meshNetworks, ServiceDiscovery: memory.NewServiceDiscovery()}
+	if err := env.InitNetworksManager(xdsUpdater); err != nil {
+		t.Fatal(err)
+	}
+
+	meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw: &meshconfig.Network_IstioNetworkGateway_Address{
+				Address: gwHost,
+			},
+			Port: 15443,
+		}}},
+	}})
+	xdsUpdater.WaitOrFail(t, "xds full")
+	last := fmt.Sprint(env.NetworkManager.AllGateways())
+
+	// Every subsequent push observed while the upstream keeps flapping must
+	// correspond to a real, distinct gateway set: never a repeat of the
+	// previous push (that would mean a redundant push slipped through), and
+	// never the same state pushed twice in a row.
+	for i := 0; i < 5; i++ {
+		xdsUpdater.WaitOrFail(t, "xds full")
+		current := fmt.Sprint(env.NetworkManager.AllGateways())
+		if current == last {
+			t.Fatalf("push %d: gateways did not actually change (%s), but a push was still observed", i, current)
+		}
+		last = current
+	}
+}
+
+func TestGatewayQueryStrategy(t *testing.T) {
+	test.SetForTest(t, &model.MinGatewayTTL, time.Hour)
+
+	gwHost := "strategy.gw.istio.io"
+	dnsServer := newFakeDNSServer(":45353", 60, sets.New(gwHost))
+	model.NetworkGatewayTestDNSServers = []string{dnsServer.Server.PacketConn.LocalAddr().String()}
+	t.Cleanup(func() {
+		if err := dnsServer.Shutdown(); err != nil {
+			t.Logf("failed shutting down fake dns server: %v", err)
+		}
+	})
+
+	cases := []struct {
+		strategy string
+		wantV4   bool
+		wantV6   bool
+	}{
+		{strategy: "ip", wantV4: true, wantV6: true},
+		{strategy: "ipv4", wantV4: true, wantV6: false},
+		{strategy: "ipv6", wantV4: false, wantV6: true},
+		{strategy: "preferv4", wantV4: true, wantV6: false},
+		{strategy: "preferv6", wantV4: false, wantV6: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			meshNetworks := mesh.NewFixedNetworksWatcher(nil)
+			xdsUpdater := xdsfake.NewFakeXDS()
+			env := &model.Environment{NetworksWatcher: meshNetworks, ServiceDiscovery: memory.NewServiceDiscovery()}
+			if err := env.InitNetworksManager(xdsUpdater); err != nil {
+				t.Fatal(err)
+			}
+			meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+				"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+					Gw: &meshconfig.Network_IstioNetworkGateway_Address{
+						Address: gwHost + "?strategy=" + tc.strategy,
+					},
+					Port: 15443,
+				}}},
+			}})
+			xdsUpdater.WaitOrFail(t, "xds full")
+
+			var gotV4, gotV6 bool
+			for _, gw := range env.NetworkManager.AllGateways() {
+				if strings.Contains(gw.Addr, ":") {
+					gotV6 = true
+				} else {
+					gotV4 = true
+				}
+			}
+			if gotV4 != tc.wantV4 || gotV6 != tc.wantV6 {
+				t.Fatalf("strategy %q: got v4=%v v6=%v, want v4=%v v6=%v", tc.strategy, gotV4, gotV6, tc.wantV4, tc.wantV6)
+			}
+		})
+	}
+
+	t.Run("preferv6 falls back to v4 on NODATA", func(t *testing.T) {
+		dnsServer.setV4Only(gwHost, true)
+		t.Cleanup(func() { dnsServer.setV4Only(gwHost, false) })
+
+		meshNetworks := mesh.NewFixedNetworksWatcher(nil)
+		xdsUpdater := xdsfake.NewFakeXDS()
+		env := &model.Environment{NetworksWatcher: meshNetworks, ServiceDiscovery: memory.NewServiceDiscovery()}
+		if err := env.InitNetworksManager(xdsUpdater); err != nil {
+			t.Fatal(err)
+		}
+		meshNetworks.SetNetworks(&meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+			"nw0": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+				Gw: &meshconfig.Network_IstioNetworkGateway_Address{
+					Address: gwHost + "?strategy=preferv6",
+				},
+				Port: 15443,
+			}}},
+		}})
+		xdsUpdater.WaitOrFail(t, "xds full")
+
+		var gotV4, gotV6 bool
+		for _, gw := range env.NetworkManager.AllGateways() {
+			if strings.Contains(gw.Addr, ":") {
+				gotV6 = true
+			} else {
+				gotV4 = true
+			}
+		}
+		if !gotV4 || gotV6 {
+			t.Fatalf("preferv6 with AAAA NODATA: got v4=%v v6=%v, want v4=true v6=false (fallback to A)", gotV4, gotV6)
+		}
+	})
+}
+
 type fakeDNSServer struct {
 	*dns.Server
 	ttl     uint32
@@ -153,15 +485,27 @@ type fakeDNSServer struct {
 	mu sync.Mutex
 	// map fqdn hostname -> successful query count
 	hosts map[string]int
+	// map fqdn SRV name -> targets it advertises
+	srvRecords map[string][]dns.SRV
+	// map fqdn SRV name -> number of SRV queries served for it, so tests can
+	// assert an upstream isn't re-queried more often than its TTL allows.
+	srvQueries map[string]int
+	// map fqdn hostname -> whether its AAAA queries should answer NODATA
+	// (empty, successful response) instead of a synthesized address, so
+	// tests can exercise the "prefer" strategies' fallback path.
+	v4Only map[string]bool
 }
 
 func newFakeDNSServer(addr string, ttl uint32, hosts sets.String) *fakeDNSServer {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	s := &fakeDNSServer{
-		Server: &dns.Server{Addr: addr, Net: "udp", NotifyStartedFunc: wg.Done},
-		ttl:    ttl,
-		hosts:  make(map[string]int, len(hosts)),
+		Server:     &dns.Server{Addr: addr, Net: "udp", NotifyStartedFunc: wg.Done},
+		ttl:        ttl,
+		hosts:      make(map[string]int, len(hosts)),
+		srvRecords: map[string][]dns.SRV{},
+		srvQueries: map[string]int{},
+		v4Only:     map[string]bool{},
 	}
 	s.Handler = s
 
@@ -185,6 +529,19 @@ func (s *fakeDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	msg := (&dns.Msg{}).SetReply(r)
 	if s.failure {
 		msg.Rcode = dns.RcodeServerFailure
+	} else if r.Question[0].Qtype == dns.TypeSRV {
+		domain := msg.Question[0].Name
+		s.srvQueries[domain]++
+		srvs, ok := s.srvRecords[domain]
+		if !ok {
+			msg.Rcode = dns.RcodeNameError
+		} else {
+			for _, srv := range srvs {
+				srv := srv
+				srv.Hdr = dns.RR_Header{Name: domain, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: s.ttl}
+				msg.Answer = append(msg.Answer, &srv)
+			}
+		}
 	} else {
 		domain := msg.Question[0].Name
 		c, ok := s.hosts[domain]
@@ -197,10 +554,12 @@ func (s *fakeDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 					A:   net.ParseIP(fmt.Sprintf("10.0.0.%d", c)),
 				})
 			case dns.TypeAAAA:
-				msg.Answer = append(msg.Answer, &dns.AAAA{
-					Hdr:  dns.RR_Header{Name: domain, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.ttl},
-					AAAA: net.ParseIP(fmt.Sprintf("fd00::%x", c)),
-				})
+				if !s.v4Only[domain] {
+					msg.Answer = append(msg.Answer, &dns.AAAA{
+						Hdr:  dns.RR_Header{Name: domain, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.ttl},
+						AAAA: net.ParseIP(fmt.Sprintf("fd00::%x", c)),
+					})
+				}
 			// simulate behavior of some public/cloud DNS like Cloudflare or DigitalOcean
 			case dns.TypeANY:
 				msg.Rcode = dns.RcodeRefused
@@ -230,3 +589,26 @@ func (s *fakeDNSServer) setFailure(failure bool) {
 	defer s.mu.Unlock()
 	s.failure = failure
 }
+
+// setSRV configures the SRV targets that name resolves to.
+func (s *fakeDNSServer) setSRV(name string, srvs []dns.SRV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.srvRecords[dns.Fqdn(name)] = srvs
+}
+
+// srvQueryCount returns how many SRV queries have been served for name.
+func (s *fakeDNSServer) srvQueryCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.srvQueries[dns.Fqdn(name)]
+}
+
+// setV4Only makes host's AAAA queries answer NODATA (an empty, successful
+// response) instead of a synthesized address, so tests can exercise the
+// "prefer" strategies' fallback path.
+func (s *fakeDNSServer) setV4Only(host string, only bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.v4Only[dns.Fqdn(host)] = only
+}